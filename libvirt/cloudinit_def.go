@@ -2,28 +2,52 @@ package libvirt
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	libvirt "github.com/digitalocean/go-libvirt"
 	diskfs "github.com/diskfs/go-diskfs"
+	diskfsfile "github.com/diskfs/go-diskfs/backend/file"
 	"github.com/diskfs/go-diskfs/disk"
 	"github.com/diskfs/go-diskfs/filesystem"
 	"github.com/diskfs/go-diskfs/filesystem/iso9660"
 	"github.com/google/uuid"
-	oldIso9660 "github.com/hooklift/iso9660"
+	"gopkg.in/yaml.v3"
 )
 
 const userDataFileName string = "user-data"
 const metaDataFileName string = "meta-data"
 const networkConfigFileName string = "network-config"
+const vendorDataFileName string = "vendor-data"
+
+// Supported values for defCloudInit.Format, and the ISO9660 volume labels
+// used to auto-detect them when reading an existing disk back.
+const (
+	cloudInitFormatNoCloud     = "nocloud"
+	cloudInitFormatConfigDrive = "configdrive"
+
+	noCloudVolumeLabel     = "cidata"
+	configDriveVolumeLabel = "config-2"
+)
+
+// inMemoryISOSizeThreshold is the largest cloud-init payload createISO will
+// build as an in-memory ISO image. Payloads above this size fall back to a
+// temporary file on disk to avoid holding oversized images in RAM.
+const inMemoryISOSizeThreshold = 4 * 1024 * 1024 // 4 MiB
 
 type defCloudInit struct {
 	Name          string
@@ -31,19 +55,38 @@ type defCloudInit struct {
 	MetaData      string `yaml:"meta_data"`
 	UserData      string `yaml:"user_data"`
 	NetworkConfig string `yaml:"network_config"`
+	VendorData    string `yaml:"vendor_data"`
+	// ExtraFiles holds arbitrary additional files (scripts, certs,
+	// mime-multipart parts, ...) to embed verbatim in the cidata ISO. Only
+	// honored for the "nocloud" Format. Keyed by the name they should
+	// appear under.
+	ExtraFiles map[string][]byte `yaml:"extra_files"`
+	// Format selects the cloud-init datasource layout written to the ISO:
+	// cloudInitFormatNoCloud (default) or cloudInitFormatConfigDrive.
+	Format string `yaml:"format"`
+}
+
+// isoArtifact is the output of createISO. Exactly one of Data or Path is
+// set: Data holds the ISO in memory for payloads at or below
+// inMemoryISOSizeThreshold, Path points at a temporary file on disk for
+// larger ones.
+type isoArtifact struct {
+	Data []byte
+	Path string
 }
 
 func newCloudInitDef() defCloudInit {
-	return defCloudInit{}
+	return defCloudInit{
+		Format: cloudInitFormatNoCloud,
+	}
 }
 
-// Create a ISO file based on the contents of the CloudInit instance and
-// uploads it to the libVirt pool
-// Returns a string holding terraform's internal ID of this resource.
-func (ci *defCloudInit) CreateIso() (string, error) {
+// CreateIso builds the cloud-init ISO for this resource, preferring to keep
+// it in memory, and returns an isoArtifact ready to be passed to UploadIso.
+func (ci *defCloudInit) CreateIso() (isoArtifact, error) {
 	iso, err := ci.createISO()
 	if err != nil {
-		return "", err
+		return isoArtifact{}, err
 	}
 	return iso, err
 }
@@ -57,7 +100,7 @@ func removeTmpIsoDirectory(iso string) {
 
 }
 
-func (ci *defCloudInit) UploadIso(client *Client, iso string) (string, error) {
+func (ci *defCloudInit) UploadIso(client *Client, iso isoArtifact) (string, error) {
 	virConn := client.libvirt
 	if virConn == nil {
 		return "", fmt.Errorf(LibVirtConIsNil)
@@ -83,17 +126,23 @@ func (ci *defCloudInit) UploadIso(client *Client, iso string) (string, error) {
 	volumeDef := newDefVolume()
 	volumeDef.Name = ci.Name
 
-	// an existing image was given, this mean we can't choose size
-	img, err := newImage(iso)
-	if err != nil {
-		return "", err
-	}
-
-	defer removeTmpIsoDirectory(iso)
+	var size uint64
+	switch {
+	case iso.Data != nil:
+		size = uint64(len(iso.Data))
+	case iso.Path != "":
+		defer removeTmpIsoDirectory(iso.Path)
 
-	size, err := img.Size()
-	if err != nil {
-		return "", err
+		img, err := newImage(iso.Path)
+		if err != nil {
+			return "", err
+		}
+		size, err = img.Size()
+		if err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("no cloud-init ISO data to upload")
 	}
 
 	volumeDef.Capacity.Unit = "B"
@@ -111,10 +160,20 @@ func (ci *defCloudInit) UploadIso(client *Client, iso string) (string, error) {
 		return "", fmt.Errorf("error creating libvirt volume for cloudinit device %s: %w", ci.Name, err)
 	}
 
-	// upload ISO file
-	err = img.Import(newCopier(virConn, &volume, uint64(size)), volumeDef)
-	if err != nil {
-		return "", fmt.Errorf("error while uploading cloudinit %s: %w", img.String(), err)
+	// upload ISO contents: stream straight from memory when we have it,
+	// otherwise fall through to the existing file-backed copier.
+	if iso.Data != nil {
+		if err := virConn.StorageVolUpload(volume, bytes.NewReader(iso.Data), 0, size, 0); err != nil {
+			return "", fmt.Errorf("error while uploading cloudinit %s: %w", ci.Name, err)
+		}
+	} else {
+		img, err := newImage(iso.Path)
+		if err != nil {
+			return "", err
+		}
+		if err := img.Import(newCopier(virConn, &volume, size), volumeDef); err != nil {
+			return "", fmt.Errorf("error while uploading cloudinit %s: %w", img.String(), err)
+		}
 	}
 
 	if volume.Key == "" {
@@ -124,11 +183,14 @@ func (ci *defCloudInit) UploadIso(client *Client, iso string) (string, error) {
 	return ci.buildTerraformKey(volume.Key), nil
 }
 
-// create a unique ID for terraform use
-// The ID is made by the volume ID (the internal one used by libvirt)
-// joined by the ";" with a UUID.
+// create a unique ID for terraform use.
+// The ID is made of the volume ID (the internal one used by libvirt) joined
+// by ";" with a sha256 hash of the cloud-init inputs that produced the ISO,
+// so that a later re-read whose hash no longer matches surfaces as drift.
+// IDs produced before this change carried a random UUID instead of the hash;
+// getCloudInitVolumeKeyFromTerraformID still accepts those.
 func (ci *defCloudInit) buildTerraformKey(volumeKey string) string {
-	return fmt.Sprintf("%s;%s", volumeKey, uuid.New())
+	return fmt.Sprintf("%s;%s", volumeKey, ci.contentHash())
 }
 
 //nolint:gomnd
@@ -140,82 +202,406 @@ func getCloudInitVolumeKeyFromTerraformID(id string) (string, error) {
 	return s[0], nil
 }
 
-// Create the ISO holding all the cloud-init data
-// Returns a string with the full path to the ISO file.
-func (ci *defCloudInit) createISO() (string, error) {
-	log.Print("Creating new ISO")
-	tmpDir, err := os.MkdirTemp("", "cloudinit")
+// contentHashFromTerraformID returns the hash half of a terraform ID built
+// by buildTerraformKey. It returns false for IDs predating content hashing
+// (i.e. ones carrying the old random UUID), since those have nothing to
+// compare against.
+func contentHashFromTerraformID(id string) (string, bool) {
+	s := strings.SplitN(id, ";", 2)
+	if len(s) != 2 {
+		return "", false
+	}
+	if _, err := uuid.Parse(s[1]); err == nil {
+		return "", false
+	}
+	return s[1], true
+}
+
+// contentHash returns a sha256 hash of ci's cloud-init inputs, used to build
+// and to drift-check a terraform ID. For the ConfigDrive format, MetaData,
+// NetworkConfig and VendorData are canonicalized the same way
+// writeConfigDriveFilesystem canonicalizes them before writing, since that is
+// what readConfigDriveFiles reads back into those fields; hashing the raw,
+// pre-canonicalization values here would make every read of a ConfigDrive
+// resource look like drift.
+func (ci *defCloudInit) contentHash() string {
+	metaData, networkConfig, vendorData := ci.MetaData, ci.NetworkConfig, ci.VendorData
+	if ci.Format == cloudInitFormatConfigDrive {
+		metaData = canonicalConfigDriveField(metaData)
+		networkConfig = canonicalConfigDriveField(networkConfig)
+		vendorData = canonicalConfigDriveField(vendorData)
+	}
+
+	h := sha256.New()
+	for _, field := range []string{ci.Format, ci.UserData, metaData, networkConfig, vendorData} {
+		fmt.Fprintf(h, "%d:%s", len(field), field)
+	}
+	for _, name := range sortedExtraFileNames(ci.ExtraFiles) {
+		contents := ci.ExtraFiles[name]
+		fmt.Fprintf(h, "%d:%s%d:%s", len(name), name, len(contents), contents)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// canonicalConfigDriveField runs raw through the same YAML-to-JSON
+// canonicalization writeConfigDriveFilesystem applies before writing a
+// ConfigDrive field to the ISO, so contentHash sees the same bytes whether
+// ci was just built from user input or read back from an existing disk. It
+// falls back to raw on error; a value that fails to canonicalize here would
+// already have made BuildCloudInitISO fail before ci's hash was ever stored.
+func canonicalConfigDriveField(raw string) string {
+	out, err := openStackJSONDocument([]byte(raw))
 	if err != nil {
-		return "", fmt.Errorf("cannot create tmp directory for cloudinit ISO generation: %w", err)
+		return raw
 	}
-	isoDestination := filepath.Join(tmpDir, ci.Name)
-	isoDisk, err := diskfs.Create(isoDestination, 10*1024*1024, diskfs.Raw, diskfs.SectorSizeDefault)
+	return string(out)
+}
+
+func sortedExtraFileNames(extraFiles map[string][]byte) []string {
+	names := make([]string, 0, len(extraFiles))
+	for name := range extraFiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// memISOFile is a minimal growable in-memory fs.File used as the backing
+// store for building cloud-init ISOs without touching the filesystem. It
+// implements backend.WritableFile (fs.File plus io.ReaderAt/io.Seeker/
+// io.WriterAt) so it can be wrapped with the diskfs file backend and handed
+// to diskfs.OpenBackend.
+type memISOFile struct {
+	data []byte
+	pos  int64
+
+	// written is the high-water mark of bytes actually written via WriteAt,
+	// which is typically far smaller than len(data) since data is
+	// pre-allocated to memISOInitialSize up front. BuildCloudInitISO trims
+	// its result to this instead of returning the padded buffer.
+	written int64
+}
+
+// memISOFileInfo is a fixed-name placeholder fs.FileInfo for memISOFile.
+// Reporting a regular-file mode matters: disk.DetermineDeviceType relies on
+// it to treat the backend as a regular file instead of a block device.
+type memISOFileInfo struct{ size int64 }
+
+func (fi memISOFileInfo) Name() string       { return "cloudinit.iso" }
+func (fi memISOFileInfo) Size() int64        { return fi.size }
+func (fi memISOFileInfo) Mode() fs.FileMode  { return 0o644 }
+func (fi memISOFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi memISOFileInfo) IsDir() bool        { return false }
+func (fi memISOFileInfo) Sys() interface{}   { return nil }
+
+func (m *memISOFile) Stat() (fs.FileInfo, error) {
+	return memISOFileInfo{size: int64(len(m.data))}, nil
+}
+
+func (m *memISOFile) Read(p []byte) (int, error) {
+	n, err := m.ReadAt(p, m.pos)
+	m.pos += int64(n)
+	return n, err
+}
+
+func (m *memISOFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *memISOFile) WriteAt(p []byte, off int64) (int, error) {
+	end := off + int64(len(p))
+	if end > int64(len(m.data)) {
+		grown := make([]byte, end)
+		copy(grown, m.data)
+		m.data = grown
+	}
+	copy(m.data[off:end], p)
+	if end > m.written {
+		m.written = end
+	}
+	return len(p), nil
+}
+
+func (m *memISOFile) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = m.pos + offset
+	case io.SeekEnd:
+		pos = int64(len(m.data)) + offset
+	default:
+		return -1, fmt.Errorf("invalid whence %d", whence)
+	}
+	m.pos = pos
+	return pos, nil
+}
+
+func (m *memISOFile) Close() error { return nil }
+
+// memISOInitialSize is the size memISOFile is pre-allocated to before any
+// filesystem is created on it. initDisk requires a backend's reported size
+// to be greater than zero, so an empty buffer isn't usable; WriteAt grows
+// the buffer on demand past this once the ISO9660 filesystem is written.
+const memISOInitialSize = 1024 * 1024 // 1 MiB
+
+// BuildCloudInitISO assembles a cloud-init ISO9660 image from the given
+// parts and returns its raw bytes. format selects the datasource layout:
+// cloudInitFormatConfigDrive produces an OpenStack ConfigDrive image and
+// rejects a non-empty extraFiles (the ConfigDrive layout has no place to put
+// them, and silently dropping them would leave ExtraFiles unable to round-
+// trip through contentHash), anything else produces the NoCloud layout.
+// BuildCloudInitISO writes the ISO image to an in-memory buffer rather than
+// to an image file, which lets it be used both by the in-memory path in
+// createISO and exercised directly in unit tests. The filesystem spec sets
+// no WorkDir, so go-diskfs still stages the individual files in a temporary
+// workspace directory on disk while the image is built.
+func BuildCloudInitISO(format string, userData, metaData, networkConfig, vendorData []byte, extraFiles map[string][]byte) ([]byte, error) {
+	mf := &memISOFile{data: make([]byte, memISOInitialSize)}
+	backend := diskfsfile.New(mf, false)
+	isoDisk, err := diskfs.OpenBackend(backend, diskfs.WithSectorSize(diskfs.SectorSizeDefault))
 	if err != nil {
-		return "", fmt.Errorf("error while creating ISO disk: %w", err)
+		return nil, fmt.Errorf("error while creating in-memory ISO disk: %w", err)
 	}
+	if err := writeCloudInitISO(isoDisk, format, userData, metaData, networkConfig, vendorData, extraFiles); err != nil {
+		return nil, err
+	}
+	return mf.data[:mf.written], nil
+}
+
+// writeCloudInitISO dispatches to the filesystem writer for format.
+func writeCloudInitISO(isoDisk *disk.Disk, format string, userData, metaData, networkConfig, vendorData []byte, extraFiles map[string][]byte) error {
+	if format == cloudInitFormatConfigDrive {
+		if len(extraFiles) > 0 {
+			return fmt.Errorf("extra_files is not supported for the %q cloud-init format", cloudInitFormatConfigDrive)
+		}
+		return writeConfigDriveFilesystem(isoDisk, userData, metaData, networkConfig, vendorData)
+	}
+	return writeCloudInitFilesystem(isoDisk, userData, metaData, networkConfig, vendorData, extraFiles)
+}
+
+// writeCloudInitFilesystem creates the cidata ISO9660 filesystem on isoDisk
+// and writes the NoCloud files into it. isoDisk may be backed by a regular
+// file or by an in-memory memISOFile.
+func writeCloudInitFilesystem(isoDisk *disk.Disk, userData, metaData, networkConfig, vendorData []byte, extraFiles map[string][]byte) error {
+	for name := range extraFiles {
+		switch name {
+		case userDataFileName, metaDataFileName, networkConfigFileName, vendorDataFileName:
+			return fmt.Errorf("extra file %q collides with a reserved cloud-init file name", name)
+		}
+	}
+
 	isoDisk.LogicalBlocksize = 2048
-	spec := disk.FilesystemSpec{Partition: 0, FSType: filesystem.TypeISO9660, VolumeLabel: "cidata"}
+	spec := disk.FilesystemSpec{Partition: 0, FSType: filesystem.TypeISO9660, VolumeLabel: noCloudVolumeLabel}
 	fs, err := isoDisk.CreateFilesystem(spec)
 	if err != nil {
-		return "", fmt.Errorf("error while creating ISO filesystem: %w", err)
+		return fmt.Errorf("error while creating ISO filesystem: %w", err)
 	}
-	for _, s := range []struct {
+
+	for _, f := range []struct {
 		name     string
-		contents string
+		contents []byte
 	}{
-		{name: userDataFileName, contents: ci.UserData},
-		{name: metaDataFileName, contents: ci.MetaData},
-		{name: networkConfigFileName, contents: ci.NetworkConfig},
+		{name: userDataFileName, contents: userData},
+		{name: metaDataFileName, contents: metaData},
+		{name: networkConfigFileName, contents: networkConfig},
+		{name: vendorDataFileName, contents: vendorData},
 	} {
-		rw, err := fs.OpenFile(s.name, os.O_CREATE|os.O_RDWR)
-		if err != nil && !errors.Is(err, io.EOF) {
-			return "", fmt.Errorf("error while opening %s: %w", s.name, err)
+		if f.contents == nil {
+			continue
 		}
-		if _, err := rw.Write([]byte(s.contents)); err != nil {
-			return "", fmt.Errorf("error while writing %s: %w", s.name, err)
+		if err := writeIso9660File(fs, f.name, f.contents); err != nil {
+			return err
+		}
+	}
+
+	for name, contents := range extraFiles {
+		if err := writeIso9660File(fs, name, contents); err != nil {
+			return err
+		}
+	}
+
+	iso, ok := fs.(*iso9660.FileSystem)
+	if !ok {
+		return fmt.Errorf("not an iso9660 filesystem")
+	}
+	if err := iso.Finalize(iso9660.FinalizeOptions{
+		RockRidge:        true,
+		VolumeIdentifier: noCloudVolumeLabel,
+	}); err != nil {
+		return fmt.Errorf("error while finalizing ISO: %w", err)
+	}
+	return nil
+}
+
+func writeIso9660File(fs filesystem.FileSystem, name string, contents []byte) error {
+	rw, err := fs.OpenFile(name, os.O_CREATE|os.O_RDWR)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("error while opening %s: %w", name, err)
+	}
+	if _, err := rw.Write(contents); err != nil {
+		return fmt.Errorf("error while writing %s: %w", name, err)
+	}
+	if err := rw.Close(); err != nil {
+		return fmt.Errorf("error while closing %s: %w", name, err)
+	}
+	return nil
+}
+
+// writeConfigDriveFilesystem creates the config-2 ISO9660 filesystem on
+// isoDisk and writes the OpenStack ConfigDrive "latest" layout into it.
+func writeConfigDriveFilesystem(isoDisk *disk.Disk, userData, metaData, networkConfig, vendorData []byte) error {
+	isoDisk.LogicalBlocksize = 2048
+	spec := disk.FilesystemSpec{Partition: 0, FSType: filesystem.TypeISO9660, VolumeLabel: configDriveVolumeLabel}
+	fs, err := isoDisk.CreateFilesystem(spec)
+	if err != nil {
+		return fmt.Errorf("error while creating ISO filesystem: %w", err)
+	}
+
+	for _, dir := range []string{"/openstack", "/openstack/latest"} {
+		if err := fs.Mkdir(dir); err != nil {
+			return fmt.Errorf("error while creating directory %s: %w", dir, err)
 		}
-		if err := rw.Close(); err != nil {
-			return "", fmt.Errorf("error while closing %s: %w", s.name, err)
+	}
+
+	metaDataJSON, err := openStackJSONDocument(metaData)
+	if err != nil {
+		return err
+	}
+	networkDataJSON, err := openStackJSONDocument(networkConfig)
+	if err != nil {
+		return err
+	}
+	vendorDataJSON, err := openStackJSONDocument(vendorData)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range []struct {
+		name     string
+		contents []byte
+	}{
+		{name: "/openstack/latest/user_data", contents: userData},
+		{name: "/openstack/latest/meta_data.json", contents: metaDataJSON},
+		{name: "/openstack/latest/network_data.json", contents: networkDataJSON},
+		{name: "/openstack/latest/vendor_data.json", contents: vendorDataJSON},
+	} {
+		if err := writeIso9660File(fs, f.name, f.contents); err != nil {
+			return err
 		}
 	}
+
 	iso, ok := fs.(*iso9660.FileSystem)
 	if !ok {
-		return "", fmt.Errorf("not an iso9660 filesystem")
+		return fmt.Errorf("not an iso9660 filesystem")
 	}
 	if err := iso.Finalize(iso9660.FinalizeOptions{
 		RockRidge:        true,
-		VolumeIdentifier: "cidata",
+		VolumeIdentifier: configDriveVolumeLabel,
 	}); err != nil {
-		return "", fmt.Errorf("error while finalizing ISO: %w", err)
+		return fmt.Errorf("error while finalizing ISO: %w", err)
+	}
+	return nil
+}
+
+// openStackJSONDocument converts a user-supplied cloud-init field (commonly
+// authored as YAML) into the JSON representation OpenStack's ConfigDrive
+// datasource expects. Empty input becomes an empty JSON object.
+func openStackJSONDocument(raw []byte) ([]byte, error) {
+	if len(raw) == 0 {
+		return []byte("{}"), nil
+	}
+	var doc interface{}
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		return nil, fmt.Errorf("error parsing cloud-init data as YAML/JSON: %w", err)
+	}
+	out, err := json.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling cloud-init data to JSON: %w", err)
+	}
+	return out, nil
+}
+
+// Create the ISO holding all the cloud-init data.
+// For payloads at or below inMemoryISOSizeThreshold the ISO image is built
+// in memory; larger payloads fall back to a temporary file on disk
+// so we don't hold an oversized image in RAM.
+func (ci *defCloudInit) createISO() (isoArtifact, error) {
+	log.Print("Creating new ISO")
+
+	userData := []byte(ci.UserData)
+	metaData := []byte(ci.MetaData)
+	networkConfig := []byte(ci.NetworkConfig)
+	vendorData := []byte(ci.VendorData)
+
+	estimatedSize := len(userData) + len(metaData) + len(networkConfig) + len(vendorData)
+	for _, contents := range ci.ExtraFiles {
+		estimatedSize += len(contents)
+	}
+
+	if estimatedSize <= inMemoryISOSizeThreshold {
+		data, err := BuildCloudInitISO(ci.Format, userData, metaData, networkConfig, vendorData, ci.ExtraFiles)
+		if err != nil {
+			return isoArtifact{}, err
+		}
+		log.Printf("ISO built in memory (%d bytes)", len(data))
+		return isoArtifact{Data: data}, nil
+	}
+
+	log.Print("cloud-init payload exceeds in-memory threshold, falling back to a temporary file")
+	tmpDir, err := os.MkdirTemp("", "cloudinit")
+	if err != nil {
+		return isoArtifact{}, fmt.Errorf("cannot create tmp directory for cloudinit ISO generation: %w", err)
+	}
+	isoDestination := filepath.Join(tmpDir, ci.Name)
+	isoDisk, err := diskfs.Create(isoDestination, 10*1024*1024, diskfs.SectorSizeDefault)
+	if err != nil {
+		return isoArtifact{}, fmt.Errorf("error while creating ISO disk: %w", err)
+	}
+	if err := writeCloudInitISO(isoDisk, ci.Format, userData, metaData, networkConfig, vendorData, ci.ExtraFiles); err != nil {
+		return isoArtifact{}, err
 	}
 	log.Printf("ISO created at %s", isoDestination)
 
-	return isoDestination, nil
+	return isoArtifact{Path: isoDestination}, nil
 }
 
 // Creates a new defCloudInit object starting from a ISO volume handled by
-// libvirt.
-func newCloudInitDefFromRemoteISO(_ context.Context, virConn *libvirt.Libvirt, id string) (defCloudInit, error) {
+// libvirt. The returned string is the terraform ID to store for this
+// resource, always rebuilt from the volume key and the data just read: it
+// equals id when id carries a content hash that still matches the ISO, and
+// differs from id when the ISO's content has drifted from that hash or when
+// id is a legacy UUID-form ID, so that Read() surfaces the drift and
+// terraform proposes replacement.
+func newCloudInitDefFromRemoteISO(_ context.Context, virConn *libvirt.Libvirt, id string) (defCloudInit, string, error) {
 	ci := defCloudInit{}
 
 	key, err := getCloudInitVolumeKeyFromTerraformID(id)
 	if err != nil {
-		return ci, err
+		return ci, "", err
 	}
 
 	volume, err := virConn.StorageVolLookupByKey(key)
 	if err != nil {
-		return ci, fmt.Errorf("can't retrieve volume %s: %w", key, err)
+		return ci, "", fmt.Errorf("can't retrieve volume %s: %w", key, err)
 	}
 
 	if volume.Name == "" {
-		return ci, fmt.Errorf("error retrieving cloudinit volume name for volume key: %s", volume.Key)
+		return ci, "", fmt.Errorf("error retrieving cloudinit volume name for volume key: %s", volume.Key)
 	}
 	ci.Name = volume.Name
 
 	err = ci.setCloudInitPoolNameFromExistingVol(virConn, volume)
 	if err != nil {
-		return ci, err
+		return ci, "", err
 	}
 
 	isoFile, err := downloadISO(virConn, volume)
@@ -224,52 +610,123 @@ func newCloudInitDefFromRemoteISO(_ context.Context, virConn *libvirt.Libvirt, i
 		defer isoFile.Close()
 	}
 	if err != nil {
-		return ci, err
+		return ci, "", err
 	}
 
 	err = ci.setCloudInitDataFromExistingCloudInitDisk(isoFile)
 	if err != nil {
-		return ci, err
+		return ci, "", err
 	}
-	return ci, nil
+
+	actualID := ci.buildTerraformKey(key)
+	if expectedHash, ok := contentHashFromTerraformID(id); ok && expectedHash != ci.contentHash() {
+		log.Printf("[DEBUG] cloud-init content for volume %s has drifted from terraform state: stored id %s, actual id %s", key, id, actualID)
+	}
+
+	return ci, actualID, nil
 }
 
-// setCloudInitDataFromExistingCloudInitDisk read and set UserData, MetaData, and NetworkConfig from existing CloudInitDisk.
+// setCloudInitDataFromExistingCloudInitDisk read and set UserData, MetaData, NetworkConfig,
+// VendorData, and ExtraFiles from an existing CloudInitDisk, auto-detecting
+// whether it holds a NoCloud or a ConfigDrive layout.
 func (ci *defCloudInit) setCloudInitDataFromExistingCloudInitDisk(isoFile *os.File) error {
-	isoReader, err := oldIso9660.NewReader(isoFile)
+	isoDisk, err := diskfs.Open(isoFile.Name())
 	if err != nil {
-		return fmt.Errorf("error initializing ISO reader: %w", err)
+		return fmt.Errorf("error opening ISO for reading: %w", err)
+	}
+	fs, err := isoDisk.GetFilesystem(0)
+	if err != nil {
+		return fmt.Errorf("error reading ISO filesystem: %w", err)
 	}
 
-	for {
-		file, err := isoReader.Next()
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				break
-			}
-			return err
-		}
+	// Label() returns the fixed 32-byte ISO9660 volume identifier field
+	// verbatim, padded with trailing NUL bytes rather than spaces.
+	if strings.Trim(fs.Label(), " \x00") == configDriveVolumeLabel {
+		ci.Format = cloudInitFormatConfigDrive
+		return ci.readConfigDriveFiles(fs)
+	}
+	ci.Format = cloudInitFormatNoCloud
+	return ci.readNoCloudFiles(fs)
+}
 
-		dataBytes, err := readIso9660File(file)
+// readNoCloudFiles reads the flat cidata layout off fs into ci.
+func (ci *defCloudInit) readNoCloudFiles(fs filesystem.FileSystem) error {
+	// ReadDir follows io/fs path rules, where the root is "." rather than "/".
+	entries, err := fs.ReadDir(".")
+	if err != nil {
+		return fmt.Errorf("error listing ISO contents: %w", err)
+	}
+
+	ci.ExtraFiles = nil
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		dataBytes, err := readIso9660Path(fs, "/"+entry.Name())
 		if err != nil {
 			return err
 		}
-		// the following filenames need to be like this because in the ios9660 reader
-		// joliet is not supported. https://github.com/hooklift/iso9660/blob/master/README.md#not-supported
-		if file.Name() == "/user_dat." {
+		switch entry.Name() {
+		case userDataFileName:
 			ci.UserData = string(dataBytes)
-		}
-		if file.Name() == "/meta_dat." {
+		case metaDataFileName:
 			ci.MetaData = string(dataBytes)
-		}
-		if file.Name() == "/network_." {
+		case networkConfigFileName:
 			ci.NetworkConfig = string(dataBytes)
+		case vendorDataFileName:
+			ci.VendorData = string(dataBytes)
+		default:
+			if ci.ExtraFiles == nil {
+				ci.ExtraFiles = make(map[string][]byte)
+			}
+			ci.ExtraFiles[entry.Name()] = dataBytes
 		}
 	}
 	log.Printf("[DEBUG]: Read cloud-init from file: %+v", ci)
 	return nil
 }
 
+// readConfigDriveFiles reads the openstack/latest layout off fs into ci.
+func (ci *defCloudInit) readConfigDriveFiles(fs filesystem.FileSystem) error {
+	ci.ExtraFiles = nil
+
+	userData, err := readIso9660Path(fs, "/openstack/latest/user_data")
+	if err != nil {
+		return err
+	}
+	ci.UserData = string(userData)
+
+	for path, field := range map[string]*string{
+		"/openstack/latest/meta_data.json":    &ci.MetaData,
+		"/openstack/latest/network_data.json": &ci.NetworkConfig,
+		"/openstack/latest/vendor_data.json":  &ci.VendorData,
+	} {
+		dataBytes, err := readIso9660Path(fs, path)
+		if err != nil {
+			return err
+		}
+		*field = string(dataBytes)
+	}
+	log.Printf("[DEBUG]: Read cloud-init from file: %+v", ci)
+	return nil
+}
+
+// readIso9660Path reads the full contents of path off an already-opened
+// ISO9660 filesystem.
+func readIso9660Path(fs filesystem.FileSystem, path string) ([]byte, error) {
+	f, err := fs.OpenFile(path, os.O_RDONLY)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %w", path, err)
+	}
+	defer f.Close()
+
+	dataBytes, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading %s: %w", path, err)
+	}
+	return dataBytes, nil
+}
+
 // FIXME Consider doing this inline.
 // setCloudInitPoolNameFromExistingVol retrieve poolname from an existing CloudInitDisk.
 func (ci *defCloudInit) setCloudInitPoolNameFromExistingVol(virConn *libvirt.Libvirt, volume libvirt.StorageVol) error {
@@ -285,16 +742,6 @@ func (ci *defCloudInit) setCloudInitPoolNameFromExistingVol(virConn *libvirt.Lib
 	return nil
 }
 
-func readIso9660File(file os.FileInfo) ([]byte, error) {
-	log.Printf("ISO reader: processing file %s", file.Name())
-
-	dataBytes, err := io.ReadAll(file.Sys().(io.Reader))
-	if err != nil {
-		return nil, fmt.Errorf("error while reading %s: %w", file.Name(), err)
-	}
-	return dataBytes, nil
-}
-
 // Downloads the ISO identified by `key` to a local tmp file.
 // Returns a pointer to the ISO file. Note well: you have to close this file
 // pointer when you are done.
@@ -4,9 +4,25 @@ import (
 	"os"
 	"testing"
 
-	"github.com/diskfs/go-diskfs"
+	diskfs "github.com/diskfs/go-diskfs"
+	diskfsfile "github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/disk"
 )
 
+// openMemISO wraps data (as produced by BuildCloudInitISO) in a memISOFile
+// and opens it read-only via diskfs, for tests that need to inspect the
+// resulting filesystem.
+func openMemISO(t *testing.T, data []byte) *disk.Disk {
+	t.Helper()
+	mf := &memISOFile{data: data}
+	backend := diskfsfile.New(mf, true)
+	isoDisk, err := diskfs.OpenBackend(backend, diskfs.WithSectorSize(diskfs.SectorSizeDefault))
+	if err != nil {
+		t.Fatalf("Failed to open iso: %v", err)
+	}
+	return isoDisk
+}
+
 func TestCloudInitTerraformKeyOps(t *testing.T) {
 	ci := newCloudInitDef()
 
@@ -23,27 +39,54 @@ func TestCloudInitTerraformKeyOps(t *testing.T) {
 	}
 }
 
-func TestCloudInitCreateISO(t *testing.T) {
+func TestCloudInitTerraformKeyBackwardCompatWithUUID(t *testing.T) {
+	legacyID := "volume-key;6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+
+	actualKey, err := getCloudInitVolumeKeyFromTerraformID(legacyID)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if actualKey != "volume-key" {
+		t.Errorf("expected volume-key, got %q", actualKey)
+	}
+
+	if _, ok := contentHashFromTerraformID(legacyID); ok {
+		t.Error("expected a legacy UUID-based id to report no content hash")
+	}
+}
+
+func TestCloudInitContentHashDetectsDrift(t *testing.T) {
 	ci := newCloudInitDef()
-	ci.Name = "test.iso"
 	ci.UserData = "test-user-data"
 	ci.MetaData = "test-meta-data"
-	ci.NetworkConfig = "test-network-config"
 
-	iso, err := ci.createISO()
-	if err != nil {
-		t.Errorf("Unexpected error: %v", err)
+	id := ci.buildTerraformKey("volume-key")
+
+	hash, ok := contentHashFromTerraformID(id)
+	if !ok {
+		t.Fatal("expected a content hash to be present")
 	}
-	if iso == "" {
-		t.Errorf("Unexpected iso to be empty")
+	if hash != ci.contentHash() {
+		t.Errorf("expected hash %q, got %q", ci.contentHash(), hash)
 	}
-	t.Logf("iso: %s", iso)
 
-	disk, err := diskfs.Open(iso)
+	ci.UserData = "drifted-user-data"
+	if hash == ci.contentHash() {
+		t.Error("expected content hash to change when the inputs change")
+	}
+}
+
+func TestBuildCloudInitISO(t *testing.T) {
+	data, err := BuildCloudInitISO(cloudInitFormatNoCloud, []byte("test-user-data"), []byte("test-meta-data"), []byte("test-network-config"), nil, nil)
 	if err != nil {
-		t.Fatalf("Failed to open iso: %v", err)
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(data) == 0 {
+		t.Fatal("expected non-empty ISO data")
 	}
-	fs, err := disk.GetFilesystem(0)
+
+	isoDisk := openMemISO(t, data)
+	fs, err := isoDisk.GetFilesystem(0)
 	if err != nil {
 		t.Fatalf("Failed to get filesystem: %v", err)
 	}
@@ -52,7 +95,171 @@ func TestCloudInitCreateISO(t *testing.T) {
 		f, err := fs.OpenFile(path, os.O_RDONLY)
 		if err != nil {
 			t.Errorf("Failed to open file %s: %v", path, err)
+			continue
+		}
+		f.Close()
+	}
+
+	if len(data) >= memISOInitialSize {
+		t.Errorf("expected a small payload to produce an ISO well under the %d-byte preallocation, got %d bytes", memISOInitialSize, len(data))
+	}
+}
+
+func TestBuildCloudInitISORejectsReservedExtraFileName(t *testing.T) {
+	extraFiles := map[string][]byte{userDataFileName: []byte("HIJACKED")}
+	_, err := BuildCloudInitISO(cloudInitFormatNoCloud, []byte("test-user-data"), nil, nil, nil, extraFiles)
+	if err == nil {
+		t.Fatal("expected an error for an extra file colliding with a reserved name")
+	}
+}
+
+func TestBuildCloudInitISORejectsConfigDriveExtraFiles(t *testing.T) {
+	extraFiles := map[string][]byte{"my-script.sh": []byte("#!/bin/sh\necho hi\n")}
+	_, err := BuildCloudInitISO(cloudInitFormatConfigDrive, []byte("test-user-data"), nil, nil, nil, extraFiles)
+	if err == nil {
+		t.Fatal("expected an error for extra_files combined with the configdrive format")
+	}
+}
+
+func TestBuildCloudInitISOConfigDrive(t *testing.T) {
+	data, err := BuildCloudInitISO(cloudInitFormatConfigDrive, []byte("test-user-data"), []byte("hostname: test"), []byte("{}"), nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(data) == 0 {
+		t.Fatal("expected non-empty ISO data")
+	}
+
+	isoDisk := openMemISO(t, data)
+	fs, err := isoDisk.GetFilesystem(0)
+	if err != nil {
+		t.Fatalf("Failed to get filesystem: %v", err)
+	}
+
+	for _, path := range []string{
+		"/openstack/latest/user_data",
+		"/openstack/latest/meta_data.json",
+		"/openstack/latest/network_data.json",
+		"/openstack/latest/vendor_data.json",
+	} {
+		f, err := fs.OpenFile(path, os.O_RDONLY)
+		if err != nil {
+			t.Errorf("Failed to open file %s: %v", path, err)
+			continue
 		}
 		f.Close()
 	}
 }
+
+func TestCloudInitCreateISO(t *testing.T) {
+	ci := newCloudInitDef()
+	ci.Name = "test.iso"
+	ci.UserData = "test-user-data"
+	ci.MetaData = "test-meta-data"
+	ci.NetworkConfig = "test-network-config"
+
+	iso, err := ci.createISO()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(iso.Data) == 0 {
+		t.Fatal("expected small cloud-init payload to be built in memory")
+	}
+}
+
+// isoArtifactFile writes an isoArtifact's in-memory data to a temp file so it
+// can be fed back into setCloudInitDataFromExistingCloudInitDisk, which
+// expects an *os.File the same way a downloaded volume would be.
+func isoArtifactFile(t *testing.T, iso isoArtifact) *os.File {
+	t.Helper()
+	f, err := os.CreateTemp(t.TempDir(), "cloudinit-roundtrip")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	if _, err := f.Write(iso.Data); err != nil {
+		t.Fatalf("Failed to write iso data: %v", err)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		t.Fatalf("Failed to seek temp file: %v", err)
+	}
+	return f
+}
+
+func TestCloudInitRoundTripNoCloud(t *testing.T) {
+	ci := newCloudInitDef()
+	ci.Name = "test.iso"
+	ci.UserData = "test-user-data"
+	ci.MetaData = "test-meta-data"
+	ci.NetworkConfig = "test-network-config"
+	ci.VendorData = "test-vendor-data"
+	ci.ExtraFiles = map[string][]byte{"my-script.sh": []byte("#!/bin/sh\necho hi\n")}
+
+	iso, err := ci.createISO()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	f := isoArtifactFile(t, iso)
+	defer f.Close()
+
+	readBack := newCloudInitDef()
+	if err := readBack.setCloudInitDataFromExistingCloudInitDisk(f); err != nil {
+		t.Fatalf("Unexpected error reading back ISO: %v", err)
+	}
+
+	if readBack.Format != cloudInitFormatNoCloud {
+		t.Errorf("expected format %q, got %q", cloudInitFormatNoCloud, readBack.Format)
+	}
+	if readBack.UserData != ci.UserData {
+		t.Errorf("UserData: expected %q, got %q", ci.UserData, readBack.UserData)
+	}
+	if readBack.MetaData != ci.MetaData {
+		t.Errorf("MetaData: expected %q, got %q", ci.MetaData, readBack.MetaData)
+	}
+	if readBack.NetworkConfig != ci.NetworkConfig {
+		t.Errorf("NetworkConfig: expected %q, got %q", ci.NetworkConfig, readBack.NetworkConfig)
+	}
+	if readBack.VendorData != ci.VendorData {
+		t.Errorf("VendorData: expected %q, got %q", ci.VendorData, readBack.VendorData)
+	}
+	if string(readBack.ExtraFiles["my-script.sh"]) != string(ci.ExtraFiles["my-script.sh"]) {
+		t.Errorf("ExtraFiles[my-script.sh]: expected %q, got %q", ci.ExtraFiles["my-script.sh"], readBack.ExtraFiles["my-script.sh"])
+	}
+}
+
+func TestCloudInitRoundTripConfigDrive(t *testing.T) {
+	ci := newCloudInitDef()
+	ci.Name = "test.iso"
+	ci.Format = cloudInitFormatConfigDrive
+	ci.UserData = "test-user-data"
+	ci.MetaData = "hostname: test"
+	ci.NetworkConfig = "{}"
+	ci.VendorData = "{}"
+
+	iso, err := ci.createISO()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	f := isoArtifactFile(t, iso)
+	defer f.Close()
+
+	readBack := newCloudInitDef()
+	if err := readBack.setCloudInitDataFromExistingCloudInitDisk(f); err != nil {
+		t.Fatalf("Unexpected error reading back ISO: %v", err)
+	}
+
+	if readBack.Format != cloudInitFormatConfigDrive {
+		t.Errorf("expected format %q, got %q", cloudInitFormatConfigDrive, readBack.Format)
+	}
+	if readBack.UserData != ci.UserData {
+		t.Errorf("UserData: expected %q, got %q", ci.UserData, readBack.UserData)
+	}
+	if readBack.MetaData != `{"hostname":"test"}` {
+		t.Errorf("MetaData: expected JSON-encoded meta-data, got %q", readBack.MetaData)
+	}
+
+	if readBack.contentHash() != ci.contentHash() {
+		t.Errorf("reading back a just-written ConfigDrive resource should not change its content hash: got %q, want %q", readBack.contentHash(), ci.contentHash())
+	}
+}